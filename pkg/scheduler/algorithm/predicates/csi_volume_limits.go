@@ -0,0 +1,315 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package predicates
+
+import (
+	"fmt"
+
+	"k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	storagev1beta1 "k8s.io/api/storage/v1beta1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	utilfeature "k8s.io/apiserver/pkg/util/feature"
+	"k8s.io/kubernetes/pkg/features"
+	"k8s.io/kubernetes/pkg/scheduler/algorithm"
+	schedulernodeinfo "k8s.io/kubernetes/pkg/scheduler/nodeinfo"
+)
+
+// CSIMaxVolumeLimitPredicate is the name this predicate is registered under
+// with the scheduler's algorithm provider.
+const CSIMaxVolumeLimitPredicate = "CSIMaxVolumeLimitChecker"
+
+// csiInTreeTranslations maps legacy in-tree volume plugin names to the CSI
+// driver name they're migrated to, so the attach-limit check still applies
+// to pods created before CSIMigration was enabled.
+var csiInTreeTranslations = map[string]string{
+	"kubernetes.io/aws-ebs":    "ebs.csi.aws.com",
+	"kubernetes.io/gce-pd":     "pd.csi.storage.gke.io",
+	"kubernetes.io/azure-disk": "disk.csi.azure.com",
+	"kubernetes.io/cinder":     "cinder.csi.openstack.org",
+}
+
+// ErrMaxVolumeCountExceeded is returned when scheduling a pod onto a node
+// would exceed one of its CSI drivers' advertised max_volumes_per_node.
+var ErrMaxVolumeCountExceeded = newPredicateFailureError(CSIMaxVolumeLimitPredicate, "node(s) exceed max CSI volume count for the pod's driver(s)")
+
+// PersistentVolumeInfo is a pluggable accessor for PV state.
+type PersistentVolumeInfo interface {
+	GetPersistentVolumeInfo(pvID string) (*v1.PersistentVolume, error)
+}
+
+// StorageClassInfo is a pluggable accessor for StorageClass state.
+type StorageClassInfo interface {
+	GetStorageClassInfo(className string) (*storagev1.StorageClass, error)
+}
+
+// CSINodeInfo is a pluggable accessor for CSINode state, used to learn how
+// many volumes of a given CSI driver a node can have attached.
+type CSINodeInfo interface {
+	GetCSINodeInfo(nodeName string) (*storagev1beta1.CSINode, error)
+}
+
+// CSIVolumeCountsMetadata holds precomputed per-driver CSI volume counts for
+// the pod being scheduled, plus a cache of each node's existing attach
+// counts that fills in lazily as candidate nodes are evaluated during a
+// single scheduling cycle. metadata.go (outside this chunk) is meant to
+// construct one per pod via NewCSIVolumeCountsMetadata and attach it to
+// algorithm.PredicateMetadata; when that's absent, CSIMaxVolumeLimitChecker
+// falls back to recomputing both the pod's own counts and each node's
+// counts from scratch, which is the O(pods) per node the metadata path
+// exists to avoid.
+type CSIVolumeCountsMetadata struct {
+	podCounts  map[string]int64
+	nodeCounts map[string]map[string]int64
+}
+
+// csiVolumeCountsMetadataProducer is implemented by predicate metadata that
+// has already computed a CSIVolumeCountsMetadata for the pod being
+// scheduled.
+type csiVolumeCountsMetadataProducer interface {
+	CSIVolumeCountsMetadata() *CSIVolumeCountsMetadata
+}
+
+// NewCSIVolumeCountsMetadata precomputes pod's own per-driver CSI volume
+// counts, for metadata.go to attach to algorithm.PredicateMetadata so every
+// node evaluated for pod in a scheduling cycle reuses it instead of
+// re-resolving pod's PVCs once per candidate node.
+func NewCSIVolumeCountsMetadata(pod *v1.Pod, checker *CSIMaxVolumeLimitChecker) (*CSIVolumeCountsMetadata, error) {
+	counts, err := checker.CSIVolumeCounts(pod)
+	if err != nil {
+		return nil, err
+	}
+	return &CSIVolumeCountsMetadata{podCounts: counts}, nil
+}
+
+// CSIMaxVolumeLimitChecker rejects pods that would push the number of CSI
+// volumes of some driver attached to a node beyond that driver's
+// NodeGetInfo.max_volumes_per_node, as reported on the node's CSINode
+// object. When predicate metadata built by NewCSIVolumeCountsMetadata is
+// available, the pod's own counts are resolved once and reused for every
+// candidate node, and each node's counts are cached in that metadata; the
+// metadata belongs to a single pod, so counts are not shared between pods,
+// even pods with equivalent PVC sets. Without it (the only path
+// that runs today, since metadata.go isn't part of this chunk), every call
+// re-resolves the pod's own PVCs and every PVC of every pod already on the
+// candidate node.
+type CSIMaxVolumeLimitChecker struct {
+	pvcInfo     PersistentVolumeClaimInfo
+	pvInfo      PersistentVolumeInfo
+	scInfo      StorageClassInfo
+	csiNodeInfo CSINodeInfo
+}
+
+// NewCSIMaxVolumeLimitPredicate returns a FitPredicate enforcing
+// driver-reported CSI attach limits.
+func NewCSIMaxVolumeLimitPredicate(pvcInfo PersistentVolumeClaimInfo, pvInfo PersistentVolumeInfo, scInfo StorageClassInfo, csiNodeInfo CSINodeInfo) algorithm.FitPredicate {
+	c := &CSIMaxVolumeLimitChecker{
+		pvcInfo:     pvcInfo,
+		pvInfo:      pvInfo,
+		scInfo:      scInfo,
+		csiNodeInfo: csiNodeInfo,
+	}
+	return c.predicate
+}
+
+func (c *CSIMaxVolumeLimitChecker) predicate(pod *v1.Pod, meta algorithm.PredicateMetadata, nodeInfo *schedulernodeinfo.NodeInfo) (bool, []algorithm.PredicateFailureReason, error) {
+	var csiMeta *CSIVolumeCountsMetadata
+	if producer, ok := meta.(csiVolumeCountsMetadataProducer); ok {
+		csiMeta = producer.CSIVolumeCountsMetadata()
+	}
+
+	newCounts, err := c.podVolumeCounts(pod, csiMeta)
+	if err != nil {
+		return false, nil, err
+	}
+	if len(newCounts) == 0 {
+		return true, nil, nil
+	}
+
+	node := nodeInfo.Node()
+	if node == nil {
+		return false, nil, fmt.Errorf("node not found")
+	}
+
+	csiNode, err := c.csiNodeInfo.GetCSINodeInfo(node.Name)
+	if err != nil {
+		// No CSINode means no CSI drivers have registered on this node yet,
+		// so there's nothing to limit against.
+		return true, nil, nil
+	}
+
+	limits := map[string]int64{}
+	for _, d := range csiNode.Spec.Drivers {
+		if d.Allocatable != nil && d.Allocatable.Count != nil {
+			limits[d.Name] = int64(*d.Allocatable.Count)
+		}
+	}
+
+	existingCounts, err := c.nodeAttachedCounts(node.Name, nodeInfo, csiMeta)
+	if err != nil {
+		return false, nil, err
+	}
+
+	for driver, toAdd := range newCounts {
+		limit, ok := limits[driver]
+		if !ok {
+			continue
+		}
+		if existingCounts[driver]+toAdd > limit {
+			return false, []algorithm.PredicateFailureReason{ErrMaxVolumeCountExceeded}, nil
+		}
+	}
+	return true, nil, nil
+}
+
+// podVolumeCounts returns csiMeta's precomputed counts for pod if available,
+// otherwise resolves them from scratch.
+func (c *CSIMaxVolumeLimitChecker) podVolumeCounts(pod *v1.Pod, csiMeta *CSIVolumeCountsMetadata) (map[string]int64, error) {
+	if csiMeta != nil && csiMeta.podCounts != nil {
+		return csiMeta.podCounts, nil
+	}
+	return c.CSIVolumeCounts(pod)
+}
+
+// nodeAttachedCounts returns, per CSI driver name, how many volumes are
+// already claimed by pods scheduled onto nodeInfo's node, reusing csiMeta's
+// per-node cache (and filling it in) when one is available so a later
+// evaluation of the same node with the same metadata doesn't re-resolve it.
+// The cache belongs to one pod's metadata and is not shared with other pods.
+func (c *CSIMaxVolumeLimitChecker) nodeAttachedCounts(nodeName string, nodeInfo *schedulernodeinfo.NodeInfo, csiMeta *CSIVolumeCountsMetadata) (map[string]int64, error) {
+	if csiMeta != nil {
+		if cached, ok := csiMeta.nodeCounts[nodeName]; ok {
+			return cached, nil
+		}
+	}
+
+	counts := map[string]int64{}
+	for _, existingPod := range nodeInfo.Pods() {
+		podCounts, err := c.CSIVolumeCounts(existingPod)
+		if err != nil {
+			return nil, err
+		}
+		for driver, n := range podCounts {
+			counts[driver] += n
+		}
+	}
+
+	if csiMeta != nil {
+		if csiMeta.nodeCounts == nil {
+			csiMeta.nodeCounts = map[string]map[string]int64{}
+		}
+		csiMeta.nodeCounts[nodeName] = counts
+	}
+	return counts, nil
+}
+
+// CSIVolumeCounts resolves each of pod's PVCs to a CSI driver name and
+// returns how many volumes the pod claims per driver. It is exported so
+// priority functions can reuse the same counts via predicate metadata
+// instead of recomputing them.
+func (c *CSIMaxVolumeLimitChecker) CSIVolumeCounts(pod *v1.Pod) (map[string]int64, error) {
+	counts := map[string]int64{}
+	seenClaims := sets.NewString()
+	for _, volume := range pod.Spec.Volumes {
+		if volume.PersistentVolumeClaim == nil {
+			continue
+		}
+		claimName := volume.PersistentVolumeClaim.ClaimName
+		if !seenClaims.Insert(claimName) {
+			// Multiple Volume entries can legally reference the same PVC;
+			// it's still only a single volume attached to the node, so it
+			// must only be counted once.
+			continue
+		}
+		driver, err := c.driverForClaim(pod.Namespace, claimName)
+		if err != nil {
+			return nil, err
+		}
+		if driver == "" {
+			continue
+		}
+		counts[driver]++
+	}
+	return counts, nil
+}
+
+// driverForClaim resolves a PVC to a CSI driver name via its bound PV, or
+// failing that via its storage class provisioner, translating in-tree
+// plugin names to their CSI equivalents when CSIMigration is enabled.
+func (c *CSIMaxVolumeLimitChecker) driverForClaim(namespace, claimName string) (string, error) {
+	pvc, err := c.pvcInfo.GetPersistentVolumeClaimInfo(namespace, claimName)
+	if err != nil {
+		return "", err
+	}
+
+	if len(pvc.Spec.VolumeName) > 0 {
+		pv, err := c.pvInfo.GetPersistentVolumeInfo(pvc.Spec.VolumeName)
+		if err != nil {
+			return "", err
+		}
+		if pv.Spec.CSI != nil {
+			return pv.Spec.CSI.Driver, nil
+		}
+		return inTreeDriverName(pv), nil
+	}
+
+	if pvc.Spec.StorageClassName == nil {
+		return "", nil
+	}
+	sc, err := c.scInfo.GetStorageClassInfo(*pvc.Spec.StorageClassName)
+	if err != nil {
+		return "", err
+	}
+	if driver, ok := translateInTreeName(sc.Provisioner); ok {
+		return driver, nil
+	}
+	return sc.Provisioner, nil
+}
+
+// inTreeDriverName maps a bound PV using an in-tree volume source to its CSI
+// driver equivalent, honoring the CSIMigration feature gate. It returns ""
+// for volume sources (e.g. hostPath, emptyDir-backed claims) that have no
+// CSI driver and therefore no attach limit to enforce.
+func inTreeDriverName(pv *v1.PersistentVolume) string {
+	var inTreePlugin string
+	switch {
+	case pv.Spec.AWSElasticBlockStore != nil:
+		inTreePlugin = "kubernetes.io/aws-ebs"
+	case pv.Spec.GCEPersistentDisk != nil:
+		inTreePlugin = "kubernetes.io/gce-pd"
+	case pv.Spec.AzureDisk != nil:
+		inTreePlugin = "kubernetes.io/azure-disk"
+	case pv.Spec.Cinder != nil:
+		inTreePlugin = "kubernetes.io/cinder"
+	default:
+		return ""
+	}
+	driver, _ := translateInTreeName(inTreePlugin)
+	return driver
+}
+
+// translateInTreeName returns the CSI driver name for an in-tree plugin
+// name, but only when CSIMigration is enabled; otherwise callers should
+// keep treating the volume as in-tree and not subject to a CSI attach
+// limit.
+func translateInTreeName(pluginName string) (string, bool) {
+	if !utilfeature.DefaultFeatureGate.Enabled(features.CSIMigration) {
+		return "", false
+	}
+	driver, ok := csiInTreeTranslations[pluginName]
+	return driver, ok
+}
@@ -0,0 +1,196 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package predicates
+
+import (
+	"fmt"
+	"testing"
+
+	"k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	storagev1beta1 "k8s.io/api/storage/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilfeature "k8s.io/apiserver/pkg/util/feature"
+	utilfeaturetesting "k8s.io/apiserver/pkg/util/feature/testing"
+	"k8s.io/kubernetes/pkg/features"
+	schedulernodeinfo "k8s.io/kubernetes/pkg/scheduler/nodeinfo"
+)
+
+type fakePVCInfo map[string]*v1.PersistentVolumeClaim
+
+func (f fakePVCInfo) GetPersistentVolumeClaimInfo(namespace, name string) (*v1.PersistentVolumeClaim, error) {
+	if pvc, ok := f[namespace+"/"+name]; ok {
+		return pvc, nil
+	}
+	return nil, fmt.Errorf("pvc %s/%s not found", namespace, name)
+}
+
+type fakePVInfo map[string]*v1.PersistentVolume
+
+func (f fakePVInfo) GetPersistentVolumeInfo(pvID string) (*v1.PersistentVolume, error) {
+	if pv, ok := f[pvID]; ok {
+		return pv, nil
+	}
+	return nil, fmt.Errorf("pv %s not found", pvID)
+}
+
+type fakeStorageClassInfo map[string]*storagev1.StorageClass
+
+func (f fakeStorageClassInfo) GetStorageClassInfo(className string) (*storagev1.StorageClass, error) {
+	if sc, ok := f[className]; ok {
+		return sc, nil
+	}
+	return nil, fmt.Errorf("storageclass %s not found", className)
+}
+
+type fakeCSINodeInfo map[string]*storagev1beta1.CSINode
+
+func (f fakeCSINodeInfo) GetCSINodeInfo(nodeName string) (*storagev1beta1.CSINode, error) {
+	if n, ok := f[nodeName]; ok {
+		return n, nil
+	}
+	return nil, fmt.Errorf("csinode %s not found", nodeName)
+}
+
+func csiVolumeCountPVC(ns, name, pvName string) *v1.PersistentVolumeClaim {
+	return &v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: name},
+		Spec:       v1.PersistentVolumeClaimSpec{VolumeName: pvName},
+	}
+}
+
+func csiPV(name, driver string) *v1.PersistentVolume {
+	return &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: v1.PersistentVolumeSpec{
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{Driver: driver},
+			},
+		},
+	}
+}
+
+func csiNodeWithLimit(nodeName, driver string, limit int32) *storagev1beta1.CSINode {
+	return &storagev1beta1.CSINode{
+		ObjectMeta: metav1.ObjectMeta{Name: nodeName},
+		Spec: storagev1beta1.CSINodeSpec{
+			Drivers: []storagev1beta1.CSINodeDriver{
+				{Name: driver, Allocatable: &storagev1beta1.VolumeNodeResources{Count: &limit}},
+			},
+		},
+	}
+}
+
+func podWithPVC(ns, name, pvcName string) *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: name},
+		Spec: v1.PodSpec{
+			Volumes: []v1.Volume{
+				{VolumeSource: v1.VolumeSource{PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{ClaimName: pvcName}}},
+			},
+		},
+	}
+}
+
+func TestCSIMaxVolumeLimitCheckerPredicate(t *testing.T) {
+	const driver = "ebs.csi.aws.com"
+	node := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1"}}
+
+	newChecker := func(limit int32) *CSIMaxVolumeLimitChecker {
+		return &CSIMaxVolumeLimitChecker{
+			pvcInfo: fakePVCInfo{
+				"default/existing-pvc": csiVolumeCountPVC("default", "existing-pvc", "pv-existing"),
+				"default/new-pvc":      csiVolumeCountPVC("default", "new-pvc", "pv-new"),
+			},
+			pvInfo: fakePVInfo{
+				"pv-existing": csiPV("pv-existing", driver),
+				"pv-new":      csiPV("pv-new", driver),
+			},
+			scInfo:      fakeStorageClassInfo{},
+			csiNodeInfo: fakeCSINodeInfo{"node1": csiNodeWithLimit("node1", driver, limit)},
+		}
+	}
+
+	existingPod := podWithPVC("default", "existing", "existing-pvc")
+	newPod := podWithPVC("default", "new", "new-pvc")
+
+	tests := []struct {
+		name    string
+		limit   int32
+		wantFit bool
+	}{
+		{name: "at limit, adding one more is rejected", limit: 1, wantFit: false},
+		{name: "under limit, adding one more fits", limit: 2, wantFit: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checker := newChecker(tt.limit)
+			ni := schedulernodeinfo.NewNodeInfo(existingPod)
+			ni.SetNode(node)
+
+			fit, reasons, err := checker.predicate(newPod, nil, ni)
+			if err != nil {
+				t.Fatalf("predicate() returned error: %v", err)
+			}
+			if fit != tt.wantFit {
+				t.Errorf("predicate() fit = %v, reasons = %v, want fit %v", fit, reasons, tt.wantFit)
+			}
+			if !tt.wantFit && len(reasons) == 0 {
+				t.Errorf("predicate() returned no failure reasons for a rejected pod")
+			}
+		})
+	}
+}
+
+func TestCSIVolumeCountsDedupsRepeatedClaim(t *testing.T) {
+	const driver = "ebs.csi.aws.com"
+	checker := &CSIMaxVolumeLimitChecker{
+		pvcInfo: fakePVCInfo{"default/data": csiVolumeCountPVC("default", "data", "pv-data")},
+		pvInfo:  fakePVInfo{"pv-data": csiPV("pv-data", driver)},
+	}
+
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "pod"},
+		Spec: v1.PodSpec{
+			Volumes: []v1.Volume{
+				{Name: "vol1", VolumeSource: v1.VolumeSource{PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{ClaimName: "data"}}},
+				{Name: "vol2", VolumeSource: v1.VolumeSource{PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{ClaimName: "data"}}},
+			},
+		},
+	}
+
+	counts, err := checker.CSIVolumeCounts(pod)
+	if err != nil {
+		t.Fatalf("CSIVolumeCounts() returned error: %v", err)
+	}
+	if got, want := counts[driver], int64(1); got != want {
+		t.Errorf("CSIVolumeCounts()[%q] = %d, want %d (two Volume entries reference the same PVC)", driver, got, want)
+	}
+}
+
+func TestTranslateInTreeNameFeatureGate(t *testing.T) {
+	defer utilfeaturetesting.SetFeatureGateDuringTest(t, utilfeature.DefaultFeatureGate, features.CSIMigration, true)()
+	if driver, ok := translateInTreeName("kubernetes.io/aws-ebs"); !ok || driver != "ebs.csi.aws.com" {
+		t.Errorf("translateInTreeName() with CSIMigration enabled = (%q, %v), want (\"ebs.csi.aws.com\", true)", driver, ok)
+	}
+
+	defer utilfeaturetesting.SetFeatureGateDuringTest(t, utilfeature.DefaultFeatureGate, features.CSIMigration, false)()
+	if driver, ok := translateInTreeName("kubernetes.io/aws-ebs"); ok {
+		t.Errorf("translateInTreeName() with CSIMigration disabled = (%q, %v), want ok=false", driver, ok)
+	}
+}
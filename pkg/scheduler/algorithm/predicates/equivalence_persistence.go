@@ -0,0 +1,517 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package predicates
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"time"
+
+	bolt "github.com/boltdb/bolt"
+	"github.com/coreos/etcd/clientv3"
+
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// ErrStaleGeneration is returned by PredicateCacheStore.Set when a
+// Tombstone for the same key was observed after the generation the caller
+// read, meaning the result being written was computed against
+// now-invalidated state.
+var ErrStaleGeneration = errors.New("predicate cache: stale generation, entry was tombstoned after it was read")
+
+// predicateCacheVersion is bumped whenever a change to predicate code could
+// change the outcome of a previously-persisted result. Entries with an
+// older Version are treated as not found, so a code change invalidates the
+// whole persisted cache automatically instead of serving stale verdicts.
+const predicateCacheVersion = 1
+
+// HashEquivalencePod computes a stable fnv64a hash of an EquivalencePod's
+// controller UID and PVC UID set, for use as the persistence key below.
+// Only the built-in controller-ref and PVC-set plugins
+// (NewControllerRefEquivalence, NewPVCSetEquivalence) contribute to the hash; the second return value is false if e wasn't
+// built from both of them, since other dimensions (topology spread,
+// scheduler name, ...) are cheap enough to recompute on every restart and
+// aren't worth persisting.
+func HashEquivalencePod(e *EquivalencePod) (uint64, bool) {
+	if e == nil {
+		return 0, false
+	}
+	var controllerUID types.UID
+	var pvcSet sets.String
+	var haveController, havePVCSet bool
+	for i, plugin := range e.plugins {
+		switch plugin.(type) {
+		case controllerRefEquivalence:
+			if uid, ok := e.keys[i].(types.UID); ok {
+				controllerUID = uid
+				haveController = true
+			}
+		case *pvcSetEquivalence:
+			if set, ok := e.keys[i].(sets.String); ok {
+				pvcSet = set
+				havePVCSet = true
+			}
+		}
+	}
+	if !haveController || !havePVCSet {
+		return 0, false
+	}
+
+	pvcUIDs := pvcSet.List()
+	sort.Strings(pvcUIDs)
+
+	h := fnv.New64a()
+	h.Write([]byte(controllerUID))
+	h.Write([]byte{0})
+	h.Write([]byte(strings.Join(pvcUIDs, ",")))
+	return h.Sum64(), true
+}
+
+// persistedPredicateResult is the on-disk/on-wire representation of a
+// single (EquivalencePod, node) predicate verdict. Generation is a
+// monotonic fencing token: Tombstone bumps it (without deleting the
+// record), and Set rejects a write whose caller-supplied generation is
+// older than what's already stored, so a predicate evaluation that started
+// before an invalidation can't resurrect stale data by writing after it.
+type persistedPredicateResult struct {
+	Version    int      `json:"version"`
+	Generation int64    `json:"generation"`
+	Tombstoned bool     `json:"tombstoned,omitempty"`
+	Fit        bool     `json:"fit"`
+	Reasons    []string `json:"reasons,omitempty"`
+}
+
+// PredicateCacheStore persists predicate results keyed by an
+// EquivalencePod's hash (see HashEquivalencePod) and node name, so a
+// freshly restarted scheduler can warm its in-memory equivalence cache
+// instead of recomputing every predicate from scratch.
+type PredicateCacheStore interface {
+	// Get returns the persisted result for (podKey, nodeName), if any and
+	// if it isn't a tombstone or a stale version.
+	Get(podKey uint64, nodeName string) (fit bool, reasons []string, found bool, err error)
+	// Generation returns the current fencing generation for (podKey,
+	// nodeName). Callers should read it before computing a predicate
+	// result and pass it back to Set.
+	Generation(podKey uint64, nodeName string) (int64, error)
+	// Set persists the result for (podKey, nodeName), stamped with
+	// generation (as read from a prior Generation call made before the
+	// result was computed). If a Tombstone for this key has bumped the
+	// stored generation past generation in the meantime, the write is
+	// rejected with ErrStaleGeneration instead of resurrecting stale data.
+	Set(podKey uint64, nodeName string, fit bool, reasons []string, generation int64) error
+	// Tombstone invalidates (podKey, nodeName) by bumping its fencing
+	// generation and clearing the stored result; if nodeName is "", every
+	// node's entry for podKey is invalidated. Unlike a bare delete, this
+	// leaves a marker behind so a concurrent or out-of-order Set for the
+	// same key from before the invalidating event is rejected by Set
+	// rather than silently recreating the stale entry.
+	Tombstone(podKey uint64, nodeName string) error
+	// ForEach calls fn once for every non-tombstoned, current-version entry
+	// in the store. It's used to warm an in-memory cache on startup.
+	ForEach(fn func(podKey uint64, nodeName string, fit bool, reasons []string) error) error
+	// Close releases any resources (file handles, client connections) held
+	// by the store.
+	Close() error
+}
+
+// boltPredicateCacheStore is the default PredicateCacheStore, backed by a
+// local BoltDB file. It's meant for a single scheduler instance; clusters
+// running multiple scheduler replicas against shared state should use an
+// etcdPredicateCacheStore instead.
+type boltPredicateCacheStore struct {
+	db     *bolt.DB
+	bucket []byte
+}
+
+var predicateCacheBucket = []byte("equivalenceCache")
+
+// NewBoltPredicateCacheStore opens (creating if necessary) a BoltDB file at
+// path to use as the equivalence cache's persistence backend.
+func NewBoltPredicateCacheStore(path string) (PredicateCacheStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("opening equivalence cache store %q: %v", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(predicateCacheBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("initializing equivalence cache store %q: %v", path, err)
+	}
+	return &boltPredicateCacheStore{db: db, bucket: predicateCacheBucket}, nil
+}
+
+func cacheKey(podKey uint64, nodeName string) []byte {
+	return []byte(fmt.Sprintf("%016x/%s", podKey, nodeName))
+}
+
+func cacheKeyPrefix(podKey uint64) []byte {
+	return []byte(fmt.Sprintf("%016x/", podKey))
+}
+
+// parseCacheKey recovers (podKey, nodeName) from a key produced by
+// cacheKey, for use by ForEach implementations.
+func parseCacheKey(k []byte) (uint64, string, bool) {
+	parts := strings.SplitN(string(k), "/", 2)
+	if len(parts) != 2 {
+		return 0, "", false
+	}
+	var podKey uint64
+	if _, err := fmt.Sscanf(parts[0], "%016x", &podKey); err != nil {
+		return 0, "", false
+	}
+	return podKey, parts[1], true
+}
+
+func (s *boltPredicateCacheStore) Get(podKey uint64, nodeName string) (bool, []string, bool, error) {
+	var result persistedPredicateResult
+	found := false
+	err := s.db.View(func(tx *bolt.Tx) error {
+		raw := tx.Bucket(s.bucket).Get(cacheKey(podKey, nodeName))
+		if raw == nil {
+			return nil
+		}
+		if err := json.Unmarshal(raw, &result); err != nil {
+			return err
+		}
+		found = true
+		return nil
+	})
+	if err != nil {
+		return false, nil, false, err
+	}
+	if !found || result.Tombstoned || result.Version != predicateCacheVersion {
+		return false, nil, false, nil
+	}
+	return result.Fit, result.Reasons, true, nil
+}
+
+func (s *boltPredicateCacheStore) Generation(podKey uint64, nodeName string) (int64, error) {
+	var generation int64
+	err := s.db.View(func(tx *bolt.Tx) error {
+		raw := tx.Bucket(s.bucket).Get(cacheKey(podKey, nodeName))
+		if raw == nil {
+			return nil
+		}
+		var result persistedPredicateResult
+		if err := json.Unmarshal(raw, &result); err != nil {
+			return err
+		}
+		generation = result.Generation
+		return nil
+	})
+	return generation, err
+}
+
+func (s *boltPredicateCacheStore) Set(podKey uint64, nodeName string, fit bool, reasons []string, generation int64) error {
+	key := cacheKey(podKey, nodeName)
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(s.bucket)
+		current, err := currentGeneration(b, key)
+		if err != nil {
+			return err
+		}
+		if generation < current {
+			return ErrStaleGeneration
+		}
+		raw, err := json.Marshal(persistedPredicateResult{
+			Version:    predicateCacheVersion,
+			Generation: current,
+			Fit:        fit,
+			Reasons:    reasons,
+		})
+		if err != nil {
+			return err
+		}
+		return b.Put(key, raw)
+	})
+}
+
+func (s *boltPredicateCacheStore) Tombstone(podKey uint64, nodeName string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(s.bucket)
+		if nodeName != "" {
+			return tombstoneBoltKey(b, cacheKey(podKey, nodeName))
+		}
+		c := b.Cursor()
+		prefix := cacheKeyPrefix(podKey)
+		var keys [][]byte
+		for k, _ := c.Seek(prefix); k != nil && strings.HasPrefix(string(k), string(prefix)); k, _ = c.Next() {
+			keys = append(keys, append([]byte{}, k...))
+		}
+		for _, k := range keys {
+			if err := tombstoneBoltKey(b, k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltPredicateCacheStore) ForEach(fn func(podKey uint64, nodeName string, fit bool, reasons []string) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(s.bucket).ForEach(func(k, v []byte) error {
+			podKey, nodeName, ok := parseCacheKey(k)
+			if !ok {
+				return nil
+			}
+			var result persistedPredicateResult
+			if err := json.Unmarshal(v, &result); err != nil {
+				return nil
+			}
+			if result.Tombstoned || result.Version != predicateCacheVersion {
+				return nil
+			}
+			return fn(podKey, nodeName, result.Fit, result.Reasons)
+		})
+	})
+}
+
+func (s *boltPredicateCacheStore) Close() error {
+	return s.db.Close()
+}
+
+// currentGeneration returns the generation stored at key, or 0 if there's
+// no entry yet.
+func currentGeneration(b *bolt.Bucket, key []byte) (int64, error) {
+	raw := b.Get(key)
+	if raw == nil {
+		return 0, nil
+	}
+	var existing persistedPredicateResult
+	if err := json.Unmarshal(raw, &existing); err != nil {
+		return 0, err
+	}
+	return existing.Generation, nil
+}
+
+// tombstoneBoltKey overwrites key with a tombstone marker carrying a bumped
+// generation, rather than deleting it, so a Set racing with this call can
+// detect and reject the stale write.
+func tombstoneBoltKey(b *bolt.Bucket, key []byte) error {
+	current, err := currentGeneration(b, key)
+	if err != nil {
+		return err
+	}
+	raw, err := json.Marshal(persistedPredicateResult{
+		Version:    predicateCacheVersion,
+		Generation: current + 1,
+		Tombstoned: true,
+	})
+	if err != nil {
+		return err
+	}
+	return b.Put(key, raw)
+}
+
+// etcdPredicateCacheStore is an alternative PredicateCacheStore for
+// clusters that want the equivalence cache shared (and invalidated) across
+// multiple scheduler replicas instead of keeping it local to one disk.
+type etcdPredicateCacheStore struct {
+	client    *clientv3.Client
+	keyPrefix string
+}
+
+// NewEtcdPredicateCacheStore returns a PredicateCacheStore backed by etcd,
+// storing entries under keyPrefix.
+func NewEtcdPredicateCacheStore(client *clientv3.Client, keyPrefix string) PredicateCacheStore {
+	return &etcdPredicateCacheStore{client: client, keyPrefix: keyPrefix}
+}
+
+func (s *etcdPredicateCacheStore) etcdKey(podKey uint64, nodeName string) string {
+	return s.keyPrefix + string(cacheKey(podKey, nodeName))
+}
+
+func (s *etcdPredicateCacheStore) Get(podKey uint64, nodeName string) (bool, []string, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resp, err := s.client.Get(ctx, s.etcdKey(podKey, nodeName))
+	if err != nil {
+		return false, nil, false, err
+	}
+	if len(resp.Kvs) == 0 {
+		return false, nil, false, nil
+	}
+	var result persistedPredicateResult
+	if err := json.Unmarshal(resp.Kvs[0].Value, &result); err != nil {
+		return false, nil, false, err
+	}
+	if result.Tombstoned || result.Version != predicateCacheVersion {
+		return false, nil, false, nil
+	}
+	return result.Fit, result.Reasons, true, nil
+}
+
+func (s *etcdPredicateCacheStore) Generation(podKey uint64, nodeName string) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return s.currentGeneration(ctx, s.etcdKey(podKey, nodeName))
+}
+
+func (s *etcdPredicateCacheStore) currentGeneration(ctx context.Context, key string) (int64, error) {
+	resp, err := s.client.Get(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	if len(resp.Kvs) == 0 {
+		return 0, nil
+	}
+	var result persistedPredicateResult
+	if err := json.Unmarshal(resp.Kvs[0].Value, &result); err != nil {
+		return 0, err
+	}
+	return result.Generation, nil
+}
+
+func (s *etcdPredicateCacheStore) Set(podKey uint64, nodeName string, fit bool, reasons []string, generation int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	key := s.etcdKey(podKey, nodeName)
+	current, err := s.currentGeneration(ctx, key)
+	if err != nil {
+		return err
+	}
+	if generation < current {
+		return ErrStaleGeneration
+	}
+	raw, err := json.Marshal(persistedPredicateResult{
+		Version:    predicateCacheVersion,
+		Generation: current,
+		Fit:        fit,
+		Reasons:    reasons,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = s.client.Put(ctx, key, string(raw))
+	return err
+}
+
+func (s *etcdPredicateCacheStore) Tombstone(podKey uint64, nodeName string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if nodeName != "" {
+		return s.tombstoneKey(ctx, s.etcdKey(podKey, nodeName))
+	}
+	resp, err := s.client.Get(ctx, s.keyPrefix+string(cacheKeyPrefix(podKey)), clientv3.WithPrefix())
+	if err != nil {
+		return err
+	}
+	for _, kv := range resp.Kvs {
+		if err := s.tombstoneKey(ctx, string(kv.Key)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tombstoneKey overwrites key with a tombstone marker carrying a bumped
+// generation, rather than deleting it, mirroring boltPredicateCacheStore so
+// a Set racing with this call can detect and reject the stale write.
+func (s *etcdPredicateCacheStore) tombstoneKey(ctx context.Context, key string) error {
+	current, err := s.currentGeneration(ctx, key)
+	if err != nil {
+		return err
+	}
+	raw, err := json.Marshal(persistedPredicateResult{
+		Version:    predicateCacheVersion,
+		Generation: current + 1,
+		Tombstoned: true,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = s.client.Put(ctx, key, string(raw))
+	return err
+}
+
+func (s *etcdPredicateCacheStore) ForEach(fn func(podKey uint64, nodeName string, fit bool, reasons []string) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	resp, err := s.client.Get(ctx, s.keyPrefix, clientv3.WithPrefix())
+	if err != nil {
+		return err
+	}
+	for _, kv := range resp.Kvs {
+		podKey, nodeName, ok := parseCacheKey([]byte(strings.TrimPrefix(string(kv.Key), s.keyPrefix)))
+		if !ok {
+			continue
+		}
+		var result persistedPredicateResult
+		if err := json.Unmarshal(kv.Value, &result); err != nil {
+			continue
+		}
+		if result.Tombstoned || result.Version != predicateCacheVersion {
+			continue
+		}
+		if err := fn(podKey, nodeName, result.Fit, result.Reasons); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *etcdPredicateCacheStore) Close() error {
+	return s.client.Close()
+}
+
+// equivalenceCacheWarmer is the subset of the in-memory equivalence cache
+// that WarmEquivalenceCache needs. It's kept minimal and local to this file
+// so the persistence backends above don't import the scheduler's internal
+// cache package.
+type equivalenceCacheWarmer interface {
+	Set(podKey uint64, nodeName string, fit bool, reasons []string)
+}
+
+// WarmEquivalenceCache populates cache from every entry in store. It's
+// meant to be called once, on scheduler startup, before the first
+// scheduling cycle runs. It only depends on the PredicateCacheStore
+// interface, so it works with any backend (Bolt, etcd, ...), not just the
+// default local one.
+func WarmEquivalenceCache(store PredicateCacheStore, cache equivalenceCacheWarmer) error {
+	return store.ForEach(func(podKey uint64, nodeName string, fit bool, reasons []string) error {
+		cache.Set(podKey, nodeName, fit, reasons)
+		return nil
+	})
+}
+
+// InvalidateNode tombstones the persisted entry for nodeName of every podKey
+// in podKeys (entries of other pod keys are left as they are), for use by the scheduler's node event handlers (e.g. on node
+// deletion or a label/taint change that could flip predicate outcomes).
+func InvalidateNode(store PredicateCacheStore, podKeys []uint64, nodeName string) error {
+	for _, podKey := range podKeys {
+		if err := store.Tombstone(podKey, nodeName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// InvalidatePod tombstones every persisted entry for podKey across all
+// nodes, for use by the scheduler's pod/PVC event handlers (e.g. a PVC the
+// pod's equivalence class depends on was deleted or rebound).
+func InvalidatePod(store PredicateCacheStore, podKey uint64) error {
+	return store.Tombstone(podKey, "")
+}
@@ -0,0 +1,174 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package predicates
+
+import (
+	"path/filepath"
+	"testing"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func controllerPod(uid types.UID, pvcNames ...string) *v1.Pod {
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:       "default",
+			Name:            "pod",
+			OwnerReferences: []metav1.OwnerReference{{UID: uid, Controller: boolPtr(true)}},
+		},
+	}
+	for _, name := range pvcNames {
+		pod.Spec.Volumes = append(pod.Spec.Volumes, v1.Volume{
+			VolumeSource: v1.VolumeSource{PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{ClaimName: name}},
+		})
+	}
+	return pod
+}
+
+func boolPtr(b bool) *bool { return &b }
+
+func TestHashEquivalencePod(t *testing.T) {
+	pvcInfo := fakePVCInfo{
+		"default/a": csiVolumeCountPVC("default", "a", "pv-a"),
+		"default/b": csiVolumeCountPVC("default", "b", "pv-b"),
+	}
+	pvcInfo["default/a"].UID = "pvc-a-uid"
+	pvcInfo["default/b"].UID = "pvc-b-uid"
+
+	generator := NewEquivalencePodGenerator(NewControllerRefEquivalence(), NewPVCSetEquivalence(pvcInfo))
+
+	pod1 := controllerPod("controller-uid", "a", "b")
+	pod2 := controllerPod("controller-uid", "b", "a") // same set, different order
+
+	e1, ok1 := generator(pod1).(*EquivalencePod)
+	e2, ok2 := generator(pod2).(*EquivalencePod)
+	if !ok1 || !ok2 {
+		t.Fatalf("expected both pods to produce an *EquivalencePod")
+	}
+
+	hash1, ok1 := HashEquivalencePod(e1)
+	hash2, ok2 := HashEquivalencePod(e2)
+	if !ok1 || !ok2 {
+		t.Fatalf("HashEquivalencePod() ok = (%v, %v), want (true, true)", ok1, ok2)
+	}
+	if hash1 != hash2 {
+		t.Errorf("HashEquivalencePod() differed for pods with the same controller and PVC set in different order: %d != %d", hash1, hash2)
+	}
+
+	podDifferentController := controllerPod("other-controller-uid", "a", "b")
+	eDifferent, _ := generator(podDifferentController).(*EquivalencePod)
+	hashDifferent, okDifferent := HashEquivalencePod(eDifferent)
+	if !okDifferent {
+		t.Fatalf("HashEquivalencePod() ok = false for a pod with a controller and PVC set")
+	}
+	if hashDifferent == hash1 {
+		t.Errorf("HashEquivalencePod() matched for pods with different controller UIDs")
+	}
+}
+
+func TestHashEquivalencePodMissingDimension(t *testing.T) {
+	// A generator with only the controller-ref plugin can't produce the
+	// (controller, PVC set) pair HashEquivalencePod requires.
+	generator := NewEquivalencePodGenerator(NewControllerRefEquivalence())
+	pod := controllerPod("controller-uid")
+	e, _ := generator(pod).(*EquivalencePod)
+
+	if _, ok := HashEquivalencePod(e); ok {
+		t.Errorf("HashEquivalencePod() ok = true for an EquivalencePod missing the PVC-set dimension, want false")
+	}
+
+	if _, ok := HashEquivalencePod(nil); ok {
+		t.Errorf("HashEquivalencePod(nil) ok = true, want false")
+	}
+}
+
+func TestBoltPredicateCacheStoreTombstoneFencesStaleSet(t *testing.T) {
+	store, err := NewBoltPredicateCacheStore(filepath.Join(t.TempDir(), "equivalence.db"))
+	if err != nil {
+		t.Fatalf("NewBoltPredicateCacheStore() error: %v", err)
+	}
+	defer store.Close()
+
+	const podKey = uint64(42)
+	const nodeName = "node-1"
+
+	generation, err := store.Generation(podKey, nodeName)
+	if err != nil {
+		t.Fatalf("Generation() error: %v", err)
+	}
+
+	if err := store.Tombstone(podKey, nodeName); err != nil {
+		t.Fatalf("Tombstone() error: %v", err)
+	}
+
+	// A Set carrying the generation read before the Tombstone is stale and
+	// must be rejected, not silently resurrect the entry.
+	if err := store.Set(podKey, nodeName, true, nil, generation); err != ErrStaleGeneration {
+		t.Errorf("Set() with a pre-Tombstone generation = %v, want ErrStaleGeneration", err)
+	}
+
+	if _, _, found, err := store.Get(podKey, nodeName); err != nil || found {
+		t.Errorf("Get() after a rejected stale Set = (found=%v, err=%v), want (false, nil)", found, err)
+	}
+
+	// A Set reading the post-Tombstone generation succeeds normally.
+	freshGeneration, err := store.Generation(podKey, nodeName)
+	if err != nil {
+		t.Fatalf("Generation() error: %v", err)
+	}
+	if err := store.Set(podKey, nodeName, true, nil, freshGeneration); err != nil {
+		t.Fatalf("Set() with the current generation returned error: %v", err)
+	}
+	if fit, _, found, err := store.Get(podKey, nodeName); err != nil || !found || !fit {
+		t.Errorf("Get() after a fresh Set = (fit=%v, found=%v, err=%v), want (true, true, nil)", fit, found, err)
+	}
+}
+
+func TestBoltPredicateCacheStoreForEachSkipsTombstones(t *testing.T) {
+	store, err := NewBoltPredicateCacheStore(filepath.Join(t.TempDir(), "equivalence.db"))
+	if err != nil {
+		t.Fatalf("NewBoltPredicateCacheStore() error: %v", err)
+	}
+	defer store.Close()
+
+	if err := store.Set(1, "node-a", true, nil, 0); err != nil {
+		t.Fatalf("Set() error: %v", err)
+	}
+	if err := store.Set(2, "node-a", false, []string{"reason"}, 0); err != nil {
+		t.Fatalf("Set() error: %v", err)
+	}
+	if err := store.Tombstone(2, "node-a"); err != nil {
+		t.Fatalf("Tombstone() error: %v", err)
+	}
+
+	seen := map[uint64]bool{}
+	err = store.ForEach(func(podKey uint64, nodeName string, fit bool, reasons []string) error {
+		seen[podKey] = true
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ForEach() error: %v", err)
+	}
+	if !seen[1] {
+		t.Errorf("ForEach() did not visit the live entry for podKey 1")
+	}
+	if seen[2] {
+		t.Errorf("ForEach() visited the tombstoned entry for podKey 2")
+	}
+}
@@ -0,0 +1,44 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package predicates
+
+// PredicateFailureError is an algorithm.PredicateFailureReason carrying both
+// the name of the predicate that produced it and a human-readable
+// description, so callers can distinguish failure kinds programmatically
+// while still logging/displaying something useful.
+type PredicateFailureError struct {
+	PredicateName string
+	PredicateDesc string
+}
+
+var _ error = &PredicateFailureError{}
+
+func (e *PredicateFailureError) Error() string {
+	return e.PredicateDesc
+}
+
+// GetReason returns the failure description, satisfying
+// algorithm.PredicateFailureReason.
+func (e *PredicateFailureError) GetReason() string {
+	return e.PredicateDesc
+}
+
+// newPredicateFailureError builds a PredicateFailureError for the given
+// predicate name and description.
+func newPredicateFailureError(predicateName, predicateDesc string) *PredicateFailureError {
+	return &PredicateFailureError{PredicateName: predicateName, PredicateDesc: predicateDesc}
+}
@@ -0,0 +1,162 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package predicates
+
+import (
+	"net"
+
+	"k8s.io/api/core/v1"
+	schedutil "k8s.io/kubernetes/pkg/scheduler/util"
+)
+
+// portRange is an inclusive [start, end] range of host ports reserved by a
+// single container port or HostPortRange entry.
+type portRange struct {
+	start, end int32
+}
+
+// contains reports whether port falls within the range.
+func (r portRange) contains(port int32) bool {
+	return port >= r.start && port <= r.end
+}
+
+// overlaps reports whether the two ranges share at least one port.
+func (r portRange) overlaps(other portRange) bool {
+	return r.start <= other.end && other.start <= r.end
+}
+
+// HostPortInfo stores the host ports that are already in use, keyed by host
+// IP and protocol. It replaces the previous map[string]bool encoding of
+// "protocol/hostIP/hostPort" so predicates and the scheduler cache can share
+// the exact same conflict logic, including CIDR hostIPs (e.g. a pod binding
+// 10.0.0.0/24:80 conflicts with a pod binding a concrete IP in that subnet
+// on the same port) and HostPortRange reservations.
+type HostPortInfo map[string]map[string][]portRange
+
+// NewHostPortInfo creates an empty HostPortInfo.
+func NewHostPortInfo() HostPortInfo {
+	return make(HostPortInfo)
+}
+
+// normalize defaults an empty protocol to TCP and an empty/zero endPort to
+// startPort, matching how v1.ContainerPort.Protocol and HostPort are
+// defaulted elsewhere.
+func normalize(protocol string, startPort, endPort int32) (string, portRange) {
+	if len(protocol) == 0 {
+		protocol = string(v1.ProtocolTCP)
+	}
+	if endPort == 0 {
+		endPort = startPort
+	}
+	return protocol, portRange{start: startPort, end: endPort}
+}
+
+// Add records that the inclusive port range [startPort, endPort] is in use
+// on hostIP for protocol. hostIP may be a single address (e.g. "10.0.0.5")
+// or a CIDR (e.g. "10.0.0.0/24"); schedutil.DefaultBindAllHostIP ("0.0.0.0")
+// means "every address on this node".
+func (h HostPortInfo) Add(hostIP, protocol string, startPort, endPort int32) {
+	if len(hostIP) == 0 {
+		hostIP = schedutil.DefaultBindAllHostIP
+	}
+	protocol, r := normalize(protocol, startPort, endPort)
+	if h[hostIP] == nil {
+		h[hostIP] = make(map[string][]portRange)
+	}
+	h[hostIP][protocol] = append(h[hostIP][protocol], r)
+}
+
+// Remove undoes a prior Add with the same arguments.
+func (h HostPortInfo) Remove(hostIP, protocol string, startPort, endPort int32) {
+	if len(hostIP) == 0 {
+		hostIP = schedutil.DefaultBindAllHostIP
+	}
+	protocol, r := normalize(protocol, startPort, endPort)
+	ranges := h[hostIP][protocol]
+	for i, existing := range ranges {
+		if existing == r {
+			h[hostIP][protocol] = append(ranges[:i], ranges[i+1:]...)
+			break
+		}
+	}
+	if len(h[hostIP][protocol]) == 0 {
+		delete(h[hostIP], protocol)
+	}
+	if len(h[hostIP]) == 0 {
+		delete(h, hostIP)
+	}
+}
+
+// CheckConflict reports whether reserving [startPort, endPort] for protocol
+// on hostIP would conflict with anything already recorded in h.
+func (h HostPortInfo) CheckConflict(hostIP, protocol string, startPort, endPort int32) bool {
+	if len(hostIP) == 0 {
+		hostIP = schedutil.DefaultBindAllHostIP
+	}
+	protocol, want := normalize(protocol, startPort, endPort)
+
+	for existingIP, byProtocol := range h {
+		if !ipsConflict(hostIP, existingIP) {
+			continue
+		}
+		for _, existing := range byProtocol[protocol] {
+			if want.overlaps(existing) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Len returns the total number of individual host ports reserved across all
+// IPs and protocols in h.
+func (h HostPortInfo) Len() int {
+	length := 0
+	for _, byProtocol := range h {
+		for _, ranges := range byProtocol {
+			for _, r := range ranges {
+				length += int(r.end-r.start) + 1
+			}
+		}
+	}
+	return length
+}
+
+// ipsConflict reports whether two hostIPs (each either a concrete address
+// or a CIDR) can refer to an overlapping set of addresses. 0.0.0.0 always
+// conflicts, since it binds every address on the node.
+func ipsConflict(a, b string) bool {
+	if a == schedutil.DefaultBindAllHostIP || b == schedutil.DefaultBindAllHostIP {
+		return true
+	}
+	if a == b {
+		return true
+	}
+
+	aIP, aNet, aErr := net.ParseCIDR(a)
+	bIP, bNet, bErr := net.ParseCIDR(b)
+	switch {
+	case aErr == nil && bErr == nil:
+		return aNet.Contains(bIP) || bNet.Contains(aIP)
+	case aErr == nil:
+		return aNet.Contains(net.ParseIP(b))
+	case bErr == nil:
+		return bNet.Contains(net.ParseIP(a))
+	default:
+		return false
+	}
+}
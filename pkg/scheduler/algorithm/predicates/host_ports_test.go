@@ -0,0 +1,117 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package predicates
+
+import "testing"
+
+func TestHostPortInfoCheckConflict(t *testing.T) {
+	tests := []struct {
+		name                         string
+		existingIP, existingProtocol string
+		existingStart, existingEnd   int32
+		wantIP, wantProtocol         string
+		wantStart, wantEnd           int32
+		conflict                     bool
+	}{
+		{
+			name:       "same ip, same port, same protocol conflicts",
+			existingIP: "10.0.0.5", existingProtocol: "TCP", existingStart: 80, existingEnd: 80,
+			wantIP: "10.0.0.5", wantProtocol: "TCP", wantStart: 80, wantEnd: 80,
+			conflict: true,
+		},
+		{
+			name:       "same ip, same port, different protocol does not conflict",
+			existingIP: "10.0.0.5", existingProtocol: "TCP", existingStart: 80, existingEnd: 80,
+			wantIP: "10.0.0.5", wantProtocol: "UDP", wantStart: 80, wantEnd: 80,
+			conflict: false,
+		},
+		{
+			name:       "SCTP treated like any other protocol",
+			existingIP: "10.0.0.5", existingProtocol: "SCTP", existingStart: 80, existingEnd: 80,
+			wantIP: "10.0.0.5", wantProtocol: "SCTP", wantStart: 80, wantEnd: 80,
+			conflict: true,
+		},
+		{
+			name:       "SCTP does not conflict with TCP on same port",
+			existingIP: "10.0.0.5", existingProtocol: "SCTP", existingStart: 80, existingEnd: 80,
+			wantIP: "10.0.0.5", wantProtocol: "TCP", wantStart: 80, wantEnd: 80,
+			conflict: false,
+		},
+		{
+			name:       "0.0.0.0 conflicts with any concrete ip on the same port",
+			existingIP: "0.0.0.0", existingProtocol: "TCP", existingStart: 80, existingEnd: 80,
+			wantIP: "192.168.1.1", wantProtocol: "TCP", wantStart: 80, wantEnd: 80,
+			conflict: true,
+		},
+		{
+			name:       "CIDR conflicts with a concrete ip inside it on the same port",
+			existingIP: "10.0.0.0/24", existingProtocol: "TCP", existingStart: 80, existingEnd: 80,
+			wantIP: "10.0.0.17", wantProtocol: "TCP", wantStart: 80, wantEnd: 80,
+			conflict: true,
+		},
+		{
+			name:       "CIDR does not conflict with a concrete ip outside it",
+			existingIP: "10.0.0.0/24", existingProtocol: "TCP", existingStart: 80, existingEnd: 80,
+			wantIP: "10.0.1.17", wantProtocol: "TCP", wantStart: 80, wantEnd: 80,
+			conflict: false,
+		},
+		{
+			name:       "overlapping host port ranges conflict",
+			existingIP: "10.0.0.5", existingProtocol: "TCP", existingStart: 30000, existingEnd: 30010,
+			wantIP: "10.0.0.5", wantProtocol: "TCP", wantStart: 30005, wantEnd: 30020,
+			conflict: true,
+		},
+		{
+			name:       "disjoint host port ranges do not conflict",
+			existingIP: "10.0.0.5", existingProtocol: "TCP", existingStart: 30000, existingEnd: 30010,
+			wantIP: "10.0.0.5", wantProtocol: "TCP", wantStart: 30011, wantEnd: 30020,
+			conflict: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewHostPortInfo()
+			h.Add(tt.existingIP, tt.existingProtocol, tt.existingStart, tt.existingEnd)
+
+			if got := h.CheckConflict(tt.wantIP, tt.wantProtocol, tt.wantStart, tt.wantEnd); got != tt.conflict {
+				t.Errorf("CheckConflict() = %v, want %v", got, tt.conflict)
+			}
+		})
+	}
+}
+
+func TestHostPortInfoAddRemoveLen(t *testing.T) {
+	h := NewHostPortInfo()
+	h.Add("10.0.0.5", "TCP", 30000, 30010)
+	if got, want := h.Len(), 11; got != want {
+		t.Errorf("Len() after Add = %d, want %d", got, want)
+	}
+
+	h.Add("10.0.0.5", "", 80, 0)
+	if got, want := h.Len(), 12; got != want {
+		t.Errorf("Len() after defaulted Add = %d, want %d", got, want)
+	}
+
+	h.Remove("10.0.0.5", "TCP", 30000, 30010)
+	if got, want := h.Len(), 1; got != want {
+		t.Errorf("Len() after Remove = %d, want %d", got, want)
+	}
+	if h.CheckConflict("10.0.0.5", "TCP", 30005, 30005) {
+		t.Errorf("CheckConflict() after Remove should be false")
+	}
+}
@@ -0,0 +1,191 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package predicates
+
+import (
+	"fmt"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	utilfeature "k8s.io/apiserver/pkg/util/feature"
+	"k8s.io/kubernetes/pkg/features"
+	"k8s.io/kubernetes/pkg/scheduler/algorithm"
+	schedulernodeinfo "k8s.io/kubernetes/pkg/scheduler/nodeinfo"
+)
+
+// PodTopologySpreadPredicate is the name this predicate is registered under
+// with the scheduler's algorithm provider. That provider registration
+// lives in defaults.go, which isn't part of this chunk; what's implemented
+// here is the predicate itself, which defensively no-ops unless the
+// EvenPodsSpread feature gate is enabled so it's inert if it's ever reached
+// without the provider wiring.
+const PodTopologySpreadPredicate = "PodTopologySpreadConstraints"
+
+// ErrTopologySpreadConstraintsNotMatch is returned when placing a pod on a
+// node would violate one of its TopologySpreadConstraints.
+var ErrTopologySpreadConstraintsNotMatch = newPredicateFailureError(PodTopologySpreadPredicate, "node(s) didn't match pod topology spread constraints")
+
+// topologyDomainCounts is the precomputed, per-constraint count of matching
+// pods in each value of a topology key.
+type topologyDomainCounts struct {
+	constraint v1.TopologySpreadConstraint
+	selector   labels.Selector
+	// counts maps the node's value for constraint.TopologyKey to the number
+	// of constraint.LabelSelector-matching pods already in that domain.
+	counts map[string]int32
+	// min is the lowest count seen across all observed domains.
+	min int32
+}
+
+// PodTopologySpreadMetadata holds the precomputed domain counts for a pod's
+// TopologySpreadConstraints, so PodTopologySpreadChecker's predicate runs
+// in O(constraints) per node instead of O(pods * constraints).
+type PodTopologySpreadMetadata struct {
+	constraints []topologyDomainCounts
+}
+
+// topologySpreadMetadataProducer is implemented by predicate metadata that
+// has already computed a PodTopologySpreadMetadata for the pod being
+// scheduled. Building it is metadata.go's job; this predicate only
+// consumes it, and falls back to computing the counts on the fly (across
+// every node its NodeInfoLister returns) if it's absent.
+type topologySpreadMetadataProducer interface {
+	PodTopologySpreadMetadata() *PodTopologySpreadMetadata
+}
+
+// NewPodTopologySpreadMetadata precomputes, for every DoNotSchedule
+// topology spread constraint on pod, the number of matching pods per value
+// of the constraint's topology key across allNodes.
+func NewPodTopologySpreadMetadata(pod *v1.Pod, allNodes []*schedulernodeinfo.NodeInfo) (*PodTopologySpreadMetadata, error) {
+	m := &PodTopologySpreadMetadata{}
+	for _, constraint := range pod.Spec.TopologySpreadConstraints {
+		if constraint.WhenUnsatisfiable != v1.DoNotSchedule {
+			continue
+		}
+		selector, err := metav1.LabelSelectorAsSelector(constraint.LabelSelector)
+		if err != nil {
+			return nil, err
+		}
+		dc := topologyDomainCounts{constraint: constraint, selector: selector, counts: map[string]int32{}}
+		for _, nodeInfo := range allNodes {
+			node := nodeInfo.Node()
+			if node == nil {
+				continue
+			}
+			value, ok := node.Labels[constraint.TopologyKey]
+			if !ok {
+				continue
+			}
+			if _, seen := dc.counts[value]; !seen {
+				dc.counts[value] = 0
+			}
+			for _, p := range nodeInfo.Pods() {
+				if p.Namespace == pod.Namespace && selector.Matches(labels.Set(p.Labels)) {
+					dc.counts[value]++
+				}
+			}
+		}
+		dc.min = minDomainCount(dc.counts)
+		m.constraints = append(m.constraints, dc)
+	}
+	return m, nil
+}
+
+// minDomainCount returns the lowest count in counts, or 0 if counts is empty
+// (no node in the cluster currently reports the topology label).
+func minDomainCount(counts map[string]int32) int32 {
+	min := int32(0)
+	first := true
+	for _, c := range counts {
+		if first || c < min {
+			min = c
+			first = false
+		}
+	}
+	return min
+}
+
+// NodeInfoLister lists every node's NodeInfo, so the predicate's fallback
+// path can compute domain counts (and, crucially, the cluster-wide min)
+// across the whole cluster instead of just the candidate node.
+type NodeInfoLister interface {
+	List() ([]*schedulernodeinfo.NodeInfo, error)
+}
+
+// PodTopologySpreadChecker enforces pod.Spec.TopologySpreadConstraints.
+type PodTopologySpreadChecker struct {
+	nodeInfoLister NodeInfoLister
+}
+
+// NewPodTopologySpreadPredicate returns a FitPredicate enforcing
+// TopologySpreadConstraints with WhenUnsatisfiable=DoNotSchedule: a node is
+// rejected if scheduling the pod there would push its topology domain's
+// matching-pod count more than constraint.MaxSkew above the least-loaded
+// domain. Nodes missing the topology label are skipped, since the
+// constraint has nothing to say about domains it can't identify.
+func NewPodTopologySpreadPredicate(nodeInfoLister NodeInfoLister) algorithm.FitPredicate {
+	c := &PodTopologySpreadChecker{nodeInfoLister: nodeInfoLister}
+	return c.predicate
+}
+
+func (c *PodTopologySpreadChecker) predicate(pod *v1.Pod, meta algorithm.PredicateMetadata, nodeInfo *schedulernodeinfo.NodeInfo) (bool, []algorithm.PredicateFailureReason, error) {
+	if !utilfeature.DefaultFeatureGate.Enabled(features.EvenPodsSpread) {
+		return true, nil, nil
+	}
+
+	node := nodeInfo.Node()
+	if node == nil {
+		return false, nil, fmt.Errorf("node not found")
+	}
+
+	var constraints []topologyDomainCounts
+	if producer, ok := meta.(topologySpreadMetadataProducer); ok {
+		if tsm := producer.PodTopologySpreadMetadata(); tsm != nil {
+			constraints = tsm.constraints
+		}
+	}
+	if constraints == nil {
+		// No precomputed metadata is available (metadata.go, which would
+		// build it once per pod via NewPodTopologySpreadMetadata, isn't
+		// part of this chunk), so recompute it here. It's important this
+		// still spans every node in the cluster, not just nodeInfo: the
+		// min count in a constraint's domains has to be the cluster-wide
+		// min, or the skew check degenerates to "is 1 > maxSkew", which is
+		// never true and silently disables the constraint.
+		allNodes, err := c.nodeInfoLister.List()
+		if err != nil {
+			return false, nil, err
+		}
+		tsm, err := NewPodTopologySpreadMetadata(pod, allNodes)
+		if err != nil {
+			return false, nil, err
+		}
+		constraints = tsm.constraints
+	}
+
+	for _, dc := range constraints {
+		value, ok := node.Labels[dc.constraint.TopologyKey]
+		if !ok {
+			continue
+		}
+		if dc.counts[value]+1 > dc.min+dc.constraint.MaxSkew {
+			return false, []algorithm.PredicateFailureReason{ErrTopologySpreadConstraintsNotMatch}, nil
+		}
+	}
+	return true, nil, nil
+}
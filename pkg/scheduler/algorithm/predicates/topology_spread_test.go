@@ -0,0 +1,139 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package predicates
+
+import (
+	"testing"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilfeature "k8s.io/apiserver/pkg/util/feature"
+	utilfeaturetesting "k8s.io/apiserver/pkg/util/feature/testing"
+	"k8s.io/kubernetes/pkg/features"
+	schedulernodeinfo "k8s.io/kubernetes/pkg/scheduler/nodeinfo"
+)
+
+type fakeNodeInfoLister []*schedulernodeinfo.NodeInfo
+
+func (f fakeNodeInfoLister) List() ([]*schedulernodeinfo.NodeInfo, error) {
+	return f, nil
+}
+
+func zoneNode(name, zone string, pods ...*v1.Pod) *schedulernodeinfo.NodeInfo {
+	ni := schedulernodeinfo.NewNodeInfo(pods...)
+	ni.SetNode(&v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{"zone": zone}},
+	})
+	return ni
+}
+
+func labeledPod(ns, name string, labels map[string]string) *v1.Pod {
+	return &v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: name, Labels: labels}}
+}
+
+func TestPodTopologySpreadCheckerPredicate(t *testing.T) {
+	defer utilfeaturetesting.SetFeatureGateDuringTest(t, utilfeature.DefaultFeatureGate, features.EvenPodsSpread, true)()
+
+	fooLabels := map[string]string{"app": "foo"}
+	selector := &metav1.LabelSelector{MatchLabels: fooLabels}
+
+	newPod := func(maxSkew int32) *v1.Pod {
+		return &v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "new", Labels: fooLabels},
+			Spec: v1.PodSpec{
+				TopologySpreadConstraints: []v1.TopologySpreadConstraint{
+					{
+						MaxSkew:           maxSkew,
+						TopologyKey:       "zone",
+						WhenUnsatisfiable: v1.DoNotSchedule,
+						LabelSelector:     selector,
+					},
+				},
+			},
+		}
+	}
+
+	// zone-a has 2 matching pods, zone-b has 0 matching pods: min is 0.
+	nodes := fakeNodeInfoLister{
+		zoneNode("node-a", "zone-a",
+			labeledPod("default", "a1", fooLabels),
+			labeledPod("default", "a2", fooLabels)),
+		zoneNode("node-b", "zone-b"),
+	}
+
+	tests := []struct {
+		name       string
+		maxSkew    int32
+		targetNode string
+		wantFit    bool
+	}{
+		{name: "scheduling onto the already-over-loaded zone violates maxSkew=1", maxSkew: 1, targetNode: "node-a", wantFit: false},
+		{name: "scheduling onto the empty zone keeps skew within maxSkew=1", maxSkew: 1, targetNode: "node-b", wantFit: true},
+		{name: "a larger maxSkew tolerates scheduling onto the loaded zone", maxSkew: 3, targetNode: "node-a", wantFit: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checker := &PodTopologySpreadChecker{nodeInfoLister: nodes}
+			var target *schedulernodeinfo.NodeInfo
+			for _, n := range nodes {
+				if n.Node().Name == tt.targetNode {
+					target = n
+				}
+			}
+
+			fit, reasons, err := checker.predicate(newPod(tt.maxSkew), nil, target)
+			if err != nil {
+				t.Fatalf("predicate() returned error: %v", err)
+			}
+			if fit != tt.wantFit {
+				t.Errorf("predicate() fit = %v, reasons = %v, want fit %v", fit, reasons, tt.wantFit)
+			}
+		})
+	}
+}
+
+func TestPodTopologySpreadCheckerPredicateFeatureGateDisabled(t *testing.T) {
+	defer utilfeaturetesting.SetFeatureGateDuringTest(t, utilfeature.DefaultFeatureGate, features.EvenPodsSpread, false)()
+
+	fooLabels := map[string]string{"app": "foo"}
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "new", Labels: fooLabels},
+		Spec: v1.PodSpec{
+			TopologySpreadConstraints: []v1.TopologySpreadConstraint{
+				{
+					MaxSkew:           1,
+					TopologyKey:       "zone",
+					WhenUnsatisfiable: v1.DoNotSchedule,
+					LabelSelector:     &metav1.LabelSelector{MatchLabels: fooLabels},
+				},
+			},
+		},
+	}
+	overloaded := zoneNode("node-a", "zone-a",
+		labeledPod("default", "a1", fooLabels),
+		labeledPod("default", "a2", fooLabels))
+
+	checker := &PodTopologySpreadChecker{nodeInfoLister: fakeNodeInfoLister{overloaded}}
+	fit, _, err := checker.predicate(pod, nil, overloaded)
+	if err != nil {
+		t.Fatalf("predicate() returned error: %v", err)
+	}
+	if !fit {
+		t.Errorf("predicate() fit = false with EvenPodsSpread disabled, want true (no-op)")
+	}
+}
@@ -17,16 +17,18 @@ limitations under the License.
 package predicates
 
 import (
-	"strings"
+	"fmt"
+	"reflect"
+	"sort"
 
 	"github.com/golang/glog"
 
 	"k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/kubernetes/pkg/scheduler/algorithm"
-	schedutil "k8s.io/kubernetes/pkg/scheduler/util"
 )
 
 // FindLabelsInSet gets as many key/value pairs as possible out of a label set.
@@ -73,46 +75,132 @@ func CreateSelectorFromLabels(aL map[string]string) labels.Selector {
 	return labels.Set(aL).AsSelector()
 }
 
+// PersistentVolumeClaimInfo is a pluggable accessor for PVC state, so that
+// predicates don't depend on a concrete lister/informer implementation.
+type PersistentVolumeClaimInfo interface {
+	GetPersistentVolumeClaimInfo(namespace, name string) (*v1.PersistentVolumeClaim, error)
+}
+
+// EquivalenceClassPlugin computes one dimension of a pod's equivalence
+// class. EquivalencePodGenerator composes the configured plugins into a
+// single key, so operators can register additional classifiers (resource
+// requests, node selector/affinity, tolerations, topology spread
+// constraints, scheduler name, ...) to trade cache hit rate for
+// correctness without patching this file.
+type EquivalenceClassPlugin interface {
+	// Name identifies the plugin for logging purposes.
+	Name() string
+	// Key returns this plugin's contribution to the pod's equivalence key.
+	// A nil key and a nil error means the pod has no equivalence class
+	// along this dimension, which makes the whole composite key unusable
+	// (the pod is never considered equivalent to another).
+	Key(pod *v1.Pod) (interface{}, error)
+	// Compatible reports whether two keys previously returned by Key should
+	// be treated as equivalent.
+	Compatible(a, b interface{}) bool
+}
+
 // EquivalencePodGenerator is a generator of equivalence class for pod with consideration of PVC info.
 type EquivalencePodGenerator struct {
-	pvcInfo PersistentVolumeClaimInfo
+	plugins []EquivalenceClassPlugin
 }
 
-// NewEquivalencePodGenerator returns a getEquivalencePod method with consideration of PVC info.
-func NewEquivalencePodGenerator(pvcInfo PersistentVolumeClaimInfo) algorithm.GetEquivalencePodFunc {
+// NewEquivalencePodGenerator returns a getEquivalencePod method built from
+// the given plugins. Plugins are evaluated in order and ANDed together: two
+// pods are only equivalent if every plugin agrees. Passing
+// NewControllerRefEquivalence() and NewPVCSetEquivalence(pvcInfo) reproduces
+// the historical "same controller + same PVC set" behavior.
+func NewEquivalencePodGenerator(plugins ...EquivalenceClassPlugin) algorithm.GetEquivalencePodFunc {
 	g := &EquivalencePodGenerator{
-		pvcInfo: pvcInfo,
+		plugins: plugins,
 	}
 	return g.getEquivalencePod
 }
 
-// GetEquivalencePod returns a EquivalencePod which contains a group of pod attributes which can be reused.
+// getEquivalencePod returns an EquivalencePod built from every configured
+// plugin, or nil if the pod doesn't qualify for equivalence under one of
+// them (e.g. it isn't owned by a controller).
 func (e *EquivalencePodGenerator) getEquivalencePod(pod *v1.Pod) interface{} {
-	// For now we only consider pods:
-	// 1. OwnerReferences is Controller
-	// 2. with same OwnerReferences
-	// 3. with same PVC claim
-	// to be equivalent
+	if len(e.plugins) == 0 {
+		return nil
+	}
+	keys := make([]interface{}, len(e.plugins))
+	for i, plugin := range e.plugins {
+		key, err := plugin.Key(pod)
+		if err != nil {
+			glog.Warningf("[EquivalencePodGenerator] plugin %q failed for pod %v: %v", plugin.Name(), pod.GetName(), err)
+			return nil
+		}
+		if key == nil {
+			return nil
+		}
+		keys[i] = key
+	}
+	return &EquivalencePod{plugins: e.plugins, keys: keys}
+}
+
+// EquivalencePod is the composite key produced by EquivalencePodGenerator.
+type EquivalencePod struct {
+	plugins []EquivalenceClassPlugin
+	keys    []interface{}
+}
+
+// Equal reports whether two EquivalencePods were built from the same
+// plugins and are Compatible under every one of them.
+func (e *EquivalencePod) Equal(other *EquivalencePod) bool {
+	if e == nil || other == nil || len(e.plugins) != len(other.plugins) {
+		return false
+	}
+	for i, plugin := range e.plugins {
+		if plugin.Name() != other.plugins[i].Name() {
+			return false
+		}
+		if !plugin.Compatible(e.keys[i], other.keys[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// controllerRefEquivalence classifies pods by their owning controller's UID.
+type controllerRefEquivalence struct{}
+
+// NewControllerRefEquivalence returns a plugin equivalent to the original
+// EquivalencePodGenerator's controller-ref check.
+func NewControllerRefEquivalence() EquivalenceClassPlugin {
+	return controllerRefEquivalence{}
+}
+
+func (controllerRefEquivalence) Name() string { return "ControllerRef" }
+
+func (controllerRefEquivalence) Key(pod *v1.Pod) (interface{}, error) {
 	for _, ref := range pod.OwnerReferences {
 		if ref.Controller != nil && *ref.Controller {
-			if pvcSet, err := e.getPVCSet(pod); err == nil {
-				// A pod can only belongs to one controller, so let's return.
-				return &EquivalencePod{
-					ControllerRef: ref,
-					PVCSet:        pvcSet,
-				}
-			} else {
-				// If error encountered, log warning and return nil (i.e. no equivalent pod found)
-				glog.Warningf("[EquivalencePodGenerator] for pod: %v failed due to: %v", pod.GetName(), err)
-				return nil
-			}
+			// A pod can only belong to one controller, so return the first one found.
+			return ref.UID, nil
 		}
 	}
-	return nil
+	return nil, nil
 }
 
-// getPVCSet returns a set of PVC UIDs of given pod.
-func (e *EquivalencePodGenerator) getPVCSet(pod *v1.Pod) (sets.String, error) {
+func (controllerRefEquivalence) Compatible(a, b interface{}) bool {
+	return a.(types.UID) == b.(types.UID)
+}
+
+// pvcSetEquivalence classifies pods by the set of PVC UIDs they claim.
+type pvcSetEquivalence struct {
+	pvcInfo PersistentVolumeClaimInfo
+}
+
+// NewPVCSetEquivalence returns a plugin equivalent to the original
+// EquivalencePodGenerator's PVC-set check.
+func NewPVCSetEquivalence(pvcInfo PersistentVolumeClaimInfo) EquivalenceClassPlugin {
+	return &pvcSetEquivalence{pvcInfo: pvcInfo}
+}
+
+func (e *pvcSetEquivalence) Name() string { return "PVCSet" }
+
+func (e *pvcSetEquivalence) Key(pod *v1.Pod) (interface{}, error) {
 	result := sets.NewString()
 	for _, volume := range pod.Spec.Volumes {
 		if volume.PersistentVolumeClaim == nil {
@@ -125,78 +213,153 @@ func (e *EquivalencePodGenerator) getPVCSet(pod *v1.Pod) (sets.String, error) {
 		}
 		result.Insert(string(pvc.UID))
 	}
-
 	return result, nil
 }
 
-// EquivalencePod is a group of pod attributes which can be reused as equivalence to schedule other pods.
-type EquivalencePod struct {
-	ControllerRef metav1.OwnerReference
-	PVCSet        sets.String
+func (e *pvcSetEquivalence) Compatible(a, b interface{}) bool {
+	return a.(sets.String).Equal(b.(sets.String))
 }
 
-type hostPortInfo struct {
-	protocol string
-	hostIP   string
-	hostPort string
-}
+// resourceRequestsEquivalence classifies pods by their aggregate resource
+// requests, so that e.g. two differently-named pods requesting the same
+// cpu/memory still share predicate results.
+type resourceRequestsEquivalence struct{}
 
-// decode decodes string ("protocol/hostIP/hostPort") to *hostPortInfo object.
-func decode(info string) *hostPortInfo {
-	hostPortInfoSlice := strings.Split(info, "/")
+// NewResourceRequestsEquivalence returns a plugin that buckets pods by their
+// containers' total requests of every resource (cpu, memory,
+// ephemeral-storage and any extended resources alike).
+func NewResourceRequestsEquivalence() EquivalenceClassPlugin {
+	return resourceRequestsEquivalence{}
+}
 
-	protocol := hostPortInfoSlice[0]
-	hostIP := hostPortInfoSlice[1]
-	hostPort := hostPortInfoSlice[2]
+func (resourceRequestsEquivalence) Name() string { return "ResourceRequests" }
 
-	return &hostPortInfo{
-		protocol: protocol,
-		hostIP:   hostIP,
-		hostPort: hostPort,
+func (resourceRequestsEquivalence) Key(pod *v1.Pod) (interface{}, error) {
+	requests := map[v1.ResourceName]int64{}
+	for _, c := range pod.Spec.Containers {
+		for name, quantity := range c.Resources.Requests {
+			requests[name] += quantity.MilliValue()
+		}
 	}
+	return requests, nil
 }
 
-// specialPortConflictCheck detects whether specailHostPort(whose hostIP is 0.0.0.0) is conflict with otherHostPorts.
-// return true if we have a conflict.
-func specialPortConflictCheck(specialHostPort string, otherHostPorts map[string]bool) bool {
-	specialHostPortInfo := decode(specialHostPort)
+func (resourceRequestsEquivalence) Compatible(a, b interface{}) bool {
+	return reflect.DeepEqual(a, b)
+}
 
-	if specialHostPortInfo.hostIP == schedutil.DefaultBindAllHostIP {
-		// loop through all the otherHostPorts to see if there exists a conflict
-		for hostPortItem := range otherHostPorts {
-			hostPortInfo := decode(hostPortItem)
+// nodeSelectorEquivalence classifies pods by their node selector and node
+// affinity, since those constrain which nodes a pod can fit on.
+type nodeSelectorEquivalence struct{}
 
-			// if there exists one hostPortItem which has the same hostPort and protocol with the specialHostPort, that will cause a conflict
-			if specialHostPortInfo.hostPort == hostPortInfo.hostPort && specialHostPortInfo.protocol == hostPortInfo.protocol {
-				return true
-			}
-		}
+// NewNodeSelectorEquivalence returns a plugin that groups pods sharing the
+// same NodeSelector and Affinity.NodeAffinity.
+func NewNodeSelectorEquivalence() EquivalenceClassPlugin {
+	return nodeSelectorEquivalence{}
+}
 
+func (nodeSelectorEquivalence) Name() string { return "NodeSelector" }
+
+func (nodeSelectorEquivalence) Key(pod *v1.Pod) (interface{}, error) {
+	var nodeAffinity *v1.NodeAffinity
+	if pod.Spec.Affinity != nil {
+		nodeAffinity = pod.Spec.Affinity.NodeAffinity
 	}
+	return [2]interface{}{pod.Spec.NodeSelector, nodeAffinity}, nil
+}
 
-	return false
+func (nodeSelectorEquivalence) Compatible(a, b interface{}) bool {
+	return reflect.DeepEqual(a, b)
 }
 
-// portsConflict check whether existingPorts and wantPorts conflict with each other
-// return true if we have a conflict
-func portsConflict(existingPorts, wantPorts map[string]bool) bool {
+// tolerationsEquivalence classifies pods by their tolerations.
+type tolerationsEquivalence struct{}
 
-	for existingPort := range existingPorts {
-		if specialPortConflictCheck(existingPort, wantPorts) {
-			return true
-		}
+// NewTolerationsEquivalence returns a plugin that groups pods sharing the
+// same (order-independent) set of tolerations.
+func NewTolerationsEquivalence() EquivalenceClassPlugin {
+	return tolerationsEquivalence{}
+}
+
+func (tolerationsEquivalence) Name() string { return "Tolerations" }
+
+func (tolerationsEquivalence) Key(pod *v1.Pod) (interface{}, error) {
+	tolerations := append([]v1.Toleration{}, pod.Spec.Tolerations...)
+	sort.Slice(tolerations, func(i, j int) bool {
+		return tolerationSortKey(tolerations[i]) < tolerationSortKey(tolerations[j])
+	})
+	return tolerations, nil
+}
+
+func (tolerationsEquivalence) Compatible(a, b interface{}) bool {
+	return reflect.DeepEqual(a, b)
+}
+
+// tolerationSortKey builds a sort key from a Toleration's own fields rather
+// than fmt.Sprintf-ing the struct: %v on a struct formats a *nested* pointer
+// field (TolerationSeconds) as its raw memory address rather than the
+// pointed-to value, which would make the sort order (and therefore the
+// equivalence key built from it) depend on allocation addresses instead of
+// on what the toleration actually says.
+func tolerationSortKey(t v1.Toleration) string {
+	seconds := "nil"
+	if t.TolerationSeconds != nil {
+		seconds = fmt.Sprintf("%d", *t.TolerationSeconds)
 	}
+	return fmt.Sprintf("%s\x00%s\x00%s\x00%s\x00%s", t.Key, t.Operator, t.Value, t.Effect, seconds)
+}
 
-	for wantPort := range wantPorts {
-		if specialPortConflictCheck(wantPort, existingPorts) {
-			return true
-		}
+// topologySpreadConstraintsEquivalence classifies pods by their topology
+// spread constraints.
+type topologySpreadConstraintsEquivalence struct{}
 
-		// general check hostPort conflict procedure for hostIP is not 0.0.0.0
-		if existingPorts[wantPort] {
-			return true
-		}
+// NewTopologySpreadConstraintsEquivalence returns a plugin that groups pods
+// sharing the same TopologySpreadConstraints.
+func NewTopologySpreadConstraintsEquivalence() EquivalenceClassPlugin {
+	return topologySpreadConstraintsEquivalence{}
+}
+
+func (topologySpreadConstraintsEquivalence) Name() string { return "TopologySpreadConstraints" }
+
+func (topologySpreadConstraintsEquivalence) Key(pod *v1.Pod) (interface{}, error) {
+	constraints := append([]v1.TopologySpreadConstraint{}, pod.Spec.TopologySpreadConstraints...)
+	sort.Slice(constraints, func(i, j int) bool {
+		return topologySpreadConstraintSortKey(constraints[i]) < topologySpreadConstraintSortKey(constraints[j])
+	})
+	return constraints, nil
+}
+
+func (topologySpreadConstraintsEquivalence) Compatible(a, b interface{}) bool {
+	return reflect.DeepEqual(a, b)
+}
+
+// topologySpreadConstraintSortKey builds a sort key from a constraint's own
+// fields so two pods listing the same constraints in a different order land
+// on the same Key and compare equal under DeepEqual, instead of only
+// matching when the input order happened to match too.
+func topologySpreadConstraintSortKey(c v1.TopologySpreadConstraint) string {
+	var selector metav1.LabelSelector
+	if c.LabelSelector != nil {
+		selector = *c.LabelSelector
 	}
+	return fmt.Sprintf("%s\x00%d\x00%s\x00%v", c.TopologyKey, c.MaxSkew, c.WhenUnsatisfiable, selector)
+}
+
+// schedulerNameEquivalence classifies pods by their scheduler name.
+type schedulerNameEquivalence struct{}
+
+// NewSchedulerNameEquivalence returns a plugin that groups pods sharing the
+// same Spec.SchedulerName.
+func NewSchedulerNameEquivalence() EquivalenceClassPlugin {
+	return schedulerNameEquivalence{}
+}
+
+func (schedulerNameEquivalence) Name() string { return "SchedulerName" }
+
+func (schedulerNameEquivalence) Key(pod *v1.Pod) (interface{}, error) {
+	return pod.Spec.SchedulerName, nil
+}
 
-	return false
+func (schedulerNameEquivalence) Compatible(a, b interface{}) bool {
+	return a.(string) == b.(string)
 }
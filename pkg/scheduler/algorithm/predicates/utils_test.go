@@ -0,0 +1,268 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package predicates
+
+import (
+	"testing"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// keyCompatible runs plugin's Key against both pods and reports whether
+// Compatible considers the results equivalent.
+func keyCompatible(t *testing.T, plugin EquivalenceClassPlugin, a, b *v1.Pod) bool {
+	t.Helper()
+	keyA, err := plugin.Key(a)
+	if err != nil {
+		t.Fatalf("Key(a) returned error: %v", err)
+	}
+	keyB, err := plugin.Key(b)
+	if err != nil {
+		t.Fatalf("Key(b) returned error: %v", err)
+	}
+	return plugin.Compatible(keyA, keyB)
+}
+
+func TestResourceRequestsEquivalence(t *testing.T) {
+	plugin := NewResourceRequestsEquivalence()
+
+	podWithContainers := func(requests ...v1.ResourceList) *v1.Pod {
+		pod := &v1.Pod{}
+		for _, r := range requests {
+			pod.Spec.Containers = append(pod.Spec.Containers, v1.Container{Resources: v1.ResourceRequirements{Requests: r}})
+		}
+		return pod
+	}
+
+	tests := []struct {
+		name       string
+		a, b       *v1.Pod
+		compatible bool
+	}{
+		{
+			name: "same aggregate requests split across a different number of containers are compatible",
+			a: podWithContainers(v1.ResourceList{
+				v1.ResourceCPU: resource.MustParse("1"), v1.ResourceMemory: resource.MustParse("1Gi"),
+			}),
+			b: podWithContainers(
+				v1.ResourceList{v1.ResourceCPU: resource.MustParse("500m")},
+				v1.ResourceList{v1.ResourceCPU: resource.MustParse("500m"), v1.ResourceMemory: resource.MustParse("1Gi")},
+			),
+			compatible: true,
+		},
+		{
+			name:       "different aggregate requests are not compatible",
+			a:          podWithContainers(v1.ResourceList{v1.ResourceCPU: resource.MustParse("1")}),
+			b:          podWithContainers(v1.ResourceList{v1.ResourceCPU: resource.MustParse("2")}),
+			compatible: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := keyCompatible(t, plugin, tt.a, tt.b); got != tt.compatible {
+				t.Errorf("Compatible() = %v, want %v", got, tt.compatible)
+			}
+		})
+	}
+}
+
+func TestNodeSelectorEquivalence(t *testing.T) {
+	plugin := NewNodeSelectorEquivalence()
+
+	podWithSelector := func(selector map[string]string, affinity *v1.NodeAffinity) *v1.Pod {
+		pod := &v1.Pod{Spec: v1.PodSpec{NodeSelector: selector}}
+		if affinity != nil {
+			pod.Spec.Affinity = &v1.Affinity{NodeAffinity: affinity}
+		}
+		return pod
+	}
+
+	tests := []struct {
+		name       string
+		a, b       *v1.Pod
+		compatible bool
+	}{
+		{
+			name:       "same node selector, no affinity, are compatible",
+			a:          podWithSelector(map[string]string{"disk": "ssd"}, nil),
+			b:          podWithSelector(map[string]string{"disk": "ssd"}, nil),
+			compatible: true,
+		},
+		{
+			name:       "different node selectors are not compatible",
+			a:          podWithSelector(map[string]string{"disk": "ssd"}, nil),
+			b:          podWithSelector(map[string]string{"disk": "spinning"}, nil),
+			compatible: false,
+		},
+		{
+			name:       "same selector but only one pod has node affinity is not compatible",
+			a:          podWithSelector(map[string]string{"disk": "ssd"}, nil),
+			b:          podWithSelector(map[string]string{"disk": "ssd"}, &v1.NodeAffinity{}),
+			compatible: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := keyCompatible(t, plugin, tt.a, tt.b); got != tt.compatible {
+				t.Errorf("Compatible() = %v, want %v", got, tt.compatible)
+			}
+		})
+	}
+}
+
+func seconds(s int64) *int64 { return &s }
+
+func TestTolerationsEquivalence(t *testing.T) {
+	plugin := NewTolerationsEquivalence()
+
+	podWithTolerations := func(tolerations ...v1.Toleration) *v1.Pod {
+		return &v1.Pod{Spec: v1.PodSpec{Tolerations: tolerations}}
+	}
+
+	a := v1.Toleration{Key: "k1", Operator: v1.TolerationOpEqual, Value: "v1", Effect: v1.TaintEffectNoSchedule, TolerationSeconds: seconds(30)}
+	b := v1.Toleration{Key: "k2", Operator: v1.TolerationOpExists, Effect: v1.TaintEffectNoExecute}
+
+	tests := []struct {
+		name       string
+		a, b       *v1.Pod
+		compatible bool
+	}{
+		{
+			name:       "identical tolerations in the same order are compatible",
+			a:          podWithTolerations(a, b),
+			b:          podWithTolerations(a, b),
+			compatible: true,
+		},
+		{
+			// Regression test: the sort used to format the whole struct with
+			// fmt.Sprintf("%v", ...), which prints the TolerationSeconds
+			// pointer field as a raw memory address, so two pods with the
+			// same toleration set in a different input order could sort
+			// differently and wrongly compare as non-equivalent.
+			name:       "identical tolerations with equal-valued TolerationSeconds in different order are compatible",
+			a:          podWithTolerations(a, b),
+			b:          podWithTolerations(b, v1.Toleration{Key: "k1", Operator: v1.TolerationOpEqual, Value: "v1", Effect: v1.TaintEffectNoSchedule, TolerationSeconds: seconds(30)}),
+			compatible: true,
+		},
+		{
+			name:       "a different TolerationSeconds value is not compatible",
+			a:          podWithTolerations(a),
+			b:          podWithTolerations(v1.Toleration{Key: "k1", Operator: v1.TolerationOpEqual, Value: "v1", Effect: v1.TaintEffectNoSchedule, TolerationSeconds: seconds(60)}),
+			compatible: false,
+		},
+		{
+			name:       "a nil vs. set TolerationSeconds is not compatible",
+			a:          podWithTolerations(v1.Toleration{Key: "k1", Operator: v1.TolerationOpEqual, Value: "v1", Effect: v1.TaintEffectNoSchedule}),
+			b:          podWithTolerations(a),
+			compatible: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := keyCompatible(t, plugin, tt.a, tt.b); got != tt.compatible {
+				t.Errorf("Compatible() = %v, want %v", got, tt.compatible)
+			}
+		})
+	}
+}
+
+func TestTopologySpreadConstraintsEquivalence(t *testing.T) {
+	plugin := NewTopologySpreadConstraintsEquivalence()
+
+	podWithConstraints := func(constraints ...v1.TopologySpreadConstraint) *v1.Pod {
+		return &v1.Pod{Spec: v1.PodSpec{TopologySpreadConstraints: constraints}}
+	}
+
+	zone := v1.TopologySpreadConstraint{
+		MaxSkew:           1,
+		TopologyKey:       "zone",
+		WhenUnsatisfiable: v1.DoNotSchedule,
+		LabelSelector:     &metav1.LabelSelector{MatchLabels: map[string]string{"app": "foo"}},
+	}
+	hostname := v1.TopologySpreadConstraint{
+		MaxSkew:           2,
+		TopologyKey:       "hostname",
+		WhenUnsatisfiable: v1.ScheduleAnyway,
+	}
+
+	tests := []struct {
+		name       string
+		a, b       *v1.Pod
+		compatible bool
+	}{
+		{
+			name:       "identical constraints in the same order are compatible",
+			a:          podWithConstraints(zone, hostname),
+			b:          podWithConstraints(zone, hostname),
+			compatible: true,
+		},
+		{
+			// Regression test: Key used to return the constraints slice
+			// as-is, so two pods listing the same constraints in a
+			// different order were wrongly treated as non-equivalent by
+			// Compatible's reflect.DeepEqual.
+			name:       "identical constraints in a different order are compatible",
+			a:          podWithConstraints(zone, hostname),
+			b:          podWithConstraints(hostname, zone),
+			compatible: true,
+		},
+		{
+			name:       "a different MaxSkew is not compatible",
+			a:          podWithConstraints(zone),
+			b:          podWithConstraints(v1.TopologySpreadConstraint{MaxSkew: 2, TopologyKey: "zone", WhenUnsatisfiable: v1.DoNotSchedule, LabelSelector: zone.LabelSelector}),
+			compatible: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := keyCompatible(t, plugin, tt.a, tt.b); got != tt.compatible {
+				t.Errorf("Compatible() = %v, want %v", got, tt.compatible)
+			}
+		})
+	}
+}
+
+func TestSchedulerNameEquivalence(t *testing.T) {
+	plugin := NewSchedulerNameEquivalence()
+
+	podWithSchedulerName := func(name string) *v1.Pod {
+		return &v1.Pod{Spec: v1.PodSpec{SchedulerName: name}}
+	}
+
+	tests := []struct {
+		name       string
+		a, b       *v1.Pod
+		compatible bool
+	}{
+		{name: "same scheduler name is compatible", a: podWithSchedulerName("default-scheduler"), b: podWithSchedulerName("default-scheduler"), compatible: true},
+		{name: "different scheduler names are not compatible", a: podWithSchedulerName("default-scheduler"), b: podWithSchedulerName("custom-scheduler"), compatible: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := keyCompatible(t, plugin, tt.a, tt.b); got != tt.compatible {
+				t.Errorf("Compatible() = %v, want %v", got, tt.compatible)
+			}
+		})
+	}
+}